@@ -1,7 +1,14 @@
 package main
 
+import (
+	"fmt"
+	"github.com/william-lbn/websocketproxy/pkg/proxy"
+)
+
 func main() {
-	backendAddress := "http://172.24.79.116:32714/hyperos/cloudshell/nginx-ingress-demolbn" // 替换为后端服务的地址
-	proxy := NewProxy(backendAddress)                                                       // 创建代理实例
-	proxy.Start(":8080")                                                                    // 启动代理服务器
+	backendAddresses := []string{"http://172.24.79.116:32714/hyperos/cloudshell/nginx-ingress-demolbn"} // 替换为后端服务的地址列表
+	p := proxy.NewProxy(backendAddresses, proxy.RoundRobin)                                             // 创建代理实例
+	if err := p.Start(":8080"); err != nil {
+		fmt.Println("Error starting server:", err)
+	}
 }
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultDiscoveryPollInterval 是轮询式 Discovery 实现两次拉取之间的默认间隔
+const defaultDiscoveryPollInterval = 10 * time.Second
+
+// Discovery 描述一种动态后端成员发现机制。Watch 返回的 channel 每次都送出完整的、
+// 当前期望存在的后端集合（而不是增量的加入/离开事件），BackendPool.Reconcile 会
+// 拿它与池子里现有的成员做差量更新。ctx 被取消时，实现应当关闭返回的 channel
+type Discovery interface {
+	Watch(ctx context.Context) (<-chan []Backend, error)
+}
+
+// addrsToBackends 把一组地址包装成未经探测的 Backend，交给 BackendPool.Reconcile
+func addrsToBackends(addrs []string) []Backend {
+	backends := make([]Backend, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = Backend{Addr: addr}
+	}
+	return backends
+}
+
+// StaticDiscovery 是最简单的 Discovery 实现：成员是固定的一组地址，只在 Watch
+// 被调用时送出一次，此后直到 ctx 被取消都不会再变化
+type StaticDiscovery struct {
+	Addrs []string
+}
+
+// Watch 实现 Discovery 接口
+func (d *StaticDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	ch := make(chan []Backend, 1)
+	ch <- addrsToBackends(d.Addrs)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// DNSDiscovery 通过定期解析 DNS SRV 记录发现后端成员，适用于那些把自己注册为
+// SRV 记录的服务（比如 Kubernetes headless service）
+type DNSDiscovery struct {
+	Service      string // SRV 记录的 service 部分，例如 "ws"
+	Proto        string // SRV 记录的 proto 部分，例如 "tcp"
+	Domain       string // 要查询的域名
+	PollInterval time.Duration
+}
+
+// Watch 实现 Discovery 接口
+func (d *DNSDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	interval := d.PollInterval
+	if interval == 0 {
+		interval = defaultDiscoveryPollInterval
+	}
+
+	addrs, err := d.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("proxy: initial SRV lookup failed: %w", err)
+	}
+
+	ch := make(chan []Backend, 1)
+	ch <- addrsToBackends(addrs)
+
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				addrs, err := d.resolve()
+				if err != nil {
+					fmt.Println("DNS SRV lookup failed:", err)
+					continue
+				}
+				select {
+				case ch <- addrsToBackends(addrs):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (d *DNSDiscovery) resolve() ([]string, error) {
+	_, srvs, err := net.LookupSRV(d.Service, d.Proto, d.Domain)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, fmt.Sprintf("ws://%s:%d", target, srv.Port))
+	}
+	return addrs, nil
+}
+
+// WatcherDiscovery 适配任何"定期拉取当前成员列表"的外部发现系统，比如
+// ZooKeeper 的子节点列表、etcd 的 key 前缀、Consul 的健康服务列表。这些系统各自
+// 的原生 watch API 和客户端 SDK 差异很大，接入时只需要实现 Fetch，不必把对应的
+// 客户端库作为本项目的硬依赖
+type WatcherDiscovery struct {
+	// Fetch 返回当前这一轮的完整后端地址集合，例如读取 ZK 节点的子节点、
+	// etcd 某个 key 前缀下的所有 value，或 Consul 某个服务名下健康的实例列表
+	Fetch        func(ctx context.Context) ([]string, error)
+	PollInterval time.Duration
+}
+
+// Watch 实现 Discovery 接口
+func (d *WatcherDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	interval := d.PollInterval
+	if interval == 0 {
+		interval = defaultDiscoveryPollInterval
+	}
+
+	addrs, err := d.Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: initial discovery fetch failed: %w", err)
+	}
+
+	ch := make(chan []Backend, 1)
+	ch <- addrsToBackends(addrs)
+
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				addrs, err := d.Fetch(ctx)
+				if err != nil {
+					fmt.Println("Discovery fetch failed:", err)
+					continue
+				}
+				select {
+				case ch <- addrsToBackends(addrs):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// listenFDsEnv 告诉子进程它应该通过继承的文件描述符而不是重新 bind 来监听，
+// 这样父子进程交接监听 socket 的过程中不会丢失任何已经建立的客户端连接
+const listenFDsEnv = "LISTEN_FDS"
+
+// listenFD 是子进程里约定好的、继承自父进程的监听 socket 的描述符编号
+// （0、1、2 分别是 stdin/stdout/stderr，紧随其后的第一个 ExtraFiles 条目就是它）
+const listenFD = 3
+
+// Start 启动 WebSocket 代理服务器，并阻塞直到收到终止或重启信号后完成优雅关闭
+func (p *Proxy) Start(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", p.handleConnection)
+	p.server = &http.Server{Addr: address, Handler: mux}
+
+	listener, err := p.listen(address)
+	if err != nil {
+		return fmt.Errorf("proxy: failed to listen on %s: %w", address, err)
+	}
+	p.listener = listener
+
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Println("Error starting server:", err)
+		}
+	}()
+	fmt.Printf("WebSocket proxy server started on %s\n", address)
+
+	return p.waitForSignal()
+}
+
+// listen 创建监听 socket；如果 LISTEN_FDS 环境变量存在，说明这是一次零停机重启后
+// fork 出来的子进程，应当直接复用父进程传递过来的 fd，而不是重新 net.Listen
+func (p *Proxy) listen(address string) (net.Listener, error) {
+	if os.Getenv(listenFDsEnv) != "" {
+		file := os.NewFile(uintptr(listenFD), "listener")
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Inherited listening socket from parent process")
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// waitForSignal 阻塞等待 SIGTERM/SIGINT/SIGUSR2，并据此触发优雅关闭或零停机重启
+func (p *Proxy) waitForSignal() error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	for sig := range sigCh {
+		switch sig {
+		case syscall.SIGUSR2:
+			if err := p.reexec(); err != nil {
+				fmt.Println("Error re-executing for zero-downtime restart:", err)
+				continue // 重启失败就继续服务，而不是直接退出
+			}
+			return p.drain()
+		case syscall.SIGTERM, syscall.SIGINT:
+			return p.drain()
+		}
+	}
+	return nil
+}
+
+// drain 用 DrainTimeout 作为超时时间触发一次优雅关闭
+func (p *Proxy) drain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.DrainTimeout)
+	defer cancel()
+	return p.Shutdown(ctx)
+}
+
+// Shutdown 停止接受新的 WebSocket 升级请求，并等待现有会话自行结束；
+// 如果 ctx 在会话都结束前被取消，剩余的会话会收到 1001 Going Away 后被强制关闭
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.lock.Lock()
+	p.draining = true
+	p.lock.Unlock()
+
+	if p.discoveryCancel != nil {
+		p.discoveryCancel()
+	}
+	p.pool.StopHealthChecks()
+
+	if err := p.server.Shutdown(ctx); err != nil {
+		fmt.Println("Error shutting down HTTP server:", err)
+	}
+
+	allDone := make(chan struct{})
+	go func() {
+		for {
+			p.lock.Lock()
+			remaining := len(p.sessions)
+			p.lock.Unlock()
+			if remaining == 0 {
+				close(allDone)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-allDone:
+		return nil
+	case <-ctx.Done():
+		p.closeRemainingSessions()
+		return ctx.Err()
+	}
+}
+
+// closeRemainingSessions 向所有还在运行的会话发送 Going Away 关闭帧并结束它们，
+// 在优雅关闭的等待时间用尽后调用
+func (p *Proxy) closeRemainingSessions() {
+	p.lock.Lock()
+	sessions := make([]*ClientSession, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.lock.Unlock()
+
+	for _, s := range sessions {
+		s.goingAway()
+	}
+}
+
+// reexec 在收到 SIGUSR2 时 fork 一个完全相同的子进程，把监听 socket 的 fd 通过
+// ExtraFiles 交接给它，从而实现零停机重启：父进程排空现有连接的同时，子进程
+// 已经开始在同一个 socket 上接受新连接
+func (p *Proxy) reexec() error {
+	if p.PreStartProcess != nil {
+		if err := p.PreStartProcess(); err != nil {
+			return fmt.Errorf("proxy: PreStartProcess failed: %w", err)
+		}
+	}
+
+	tcpListener, ok := p.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("proxy: listener does not support fd inheritance")
+	}
+	listenerFile, err := tcpListener.File()
+	if err != nil {
+		return fmt.Errorf("proxy: failed to get listener fd: %w", err)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.ExtraFiles = []*os.File{listenerFile}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=1", listenFDsEnv))
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("proxy: failed to start child process: %w", err)
+	}
+	fmt.Printf("Re-exec'd child process (pid %d) to take over listening socket\n", cmd.Process.Pid)
+	return nil
+}
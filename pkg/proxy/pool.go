@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy 描述 BackendPool 选择后端时使用的策略
+type Policy int
+
+const (
+	RoundRobin Policy = iota // 轮询
+	Random                   // 随机
+	LeastConn                // 最少连接数优先
+)
+
+// healthCheckInterval 是健康检查的探测周期
+const healthCheckInterval = 10 * time.Second
+
+// healthCheckTimeout 是单次探测拨号的超时时间
+const healthCheckTimeout = 3 * time.Second
+
+// defaultDrainTimeout 是后端被 Discovery 移除后，池子最多等待其既有连接
+// 自行结束的时间，超过之后该后端会被强制清出池子
+const defaultDrainTimeout = 30 * time.Second
+
+// Backend 表示后端池中的一个上游 WebSocket 地址及其健康状态
+type Backend struct {
+	Addr          string    // 后端 WebSocket 地址
+	up            bool      // 健康检查认为该后端是否可用
+	activeConn    int       // 当前正在使用该后端的客户端连接数
+	draining      bool      // 已经被 Discovery 移除，不再接受新连接，但仍允许既有连接继续
+	drainDeadline time.Time // draining 状态下，超过这个时间就强制清出池子
+	drainGen      int       // 每次 startDrainingLocked 都会递增，用来让 forceEvict 分辨出自己
+	// 对应的这一轮 draining 是否早已经被后续的 Reconcile 撤销（该后端又回到了 desired 里）
+}
+
+// ErrNoBackendAvailable 表示后端池中没有可用的健康后端
+var ErrNoBackendAvailable = errors.New("proxy: no backend available")
+
+// BackendPool 管理一组后端地址，并根据 Policy 为每个客户端连接挑选后端
+type BackendPool struct {
+	mu       sync.Mutex // 保护下面的字段，避免与单个客户端连接状态相互竞争
+	backends []*Backend
+	policy   Policy
+	cursor   int // RoundRobin 使用的游标
+
+	stop chan struct{} // 关闭健康检查协程
+
+	// DrainTimeout 是 Reconcile 将某个后端标记为下线后，最多等待其既有连接
+	// 自行结束的时间
+	DrainTimeout time.Duration
+
+	// onEvict 在某个 draining 的后端因为超过 DrainTimeout 被强制清出池子时调用，
+	// 供 Proxy 借此结束仍然绑定在该后端上的会话
+	onEvict func(*Backend)
+}
+
+// NewBackendPool 创建一个新的 BackendPool，初始时所有后端都视为健康
+func NewBackendPool(addrs []string, policy Policy) *BackendPool {
+	backends := make([]*Backend, 0, len(addrs))
+	for _, addr := range addrs {
+		backends = append(backends, &Backend{Addr: addr, up: true})
+	}
+	return &BackendPool{
+		backends:     backends,
+		policy:       policy,
+		stop:         make(chan struct{}),
+		DrainTimeout: defaultDrainTimeout,
+	}
+}
+
+// Next 根据配置的策略从池中挑选一个健康的后端，并将其活跃连接数加一
+func (p *BackendPool) Next() (*Backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.policy {
+	case Random:
+		return p.pickRandomLocked()
+	case LeastConn:
+		return p.pickLeastConnLocked()
+	default:
+		return p.pickRoundRobinLocked()
+	}
+}
+
+func (p *BackendPool) pickRoundRobinLocked() (*Backend, error) {
+	n := len(p.backends)
+	for i := 0; i < n; i++ {
+		idx := (p.cursor + i) % n
+		b := p.backends[idx]
+		if b.up && !b.draining {
+			p.cursor = (idx + 1) % n
+			b.activeConn++
+			return b, nil
+		}
+	}
+	return nil, ErrNoBackendAvailable
+}
+
+func (p *BackendPool) pickRandomLocked() (*Backend, error) {
+	up := p.upBackendsLocked()
+	if len(up) == 0 {
+		return nil, ErrNoBackendAvailable
+	}
+	b := up[rand.Intn(len(up))]
+	b.activeConn++
+	return b, nil
+}
+
+func (p *BackendPool) pickLeastConnLocked() (*Backend, error) {
+	var best *Backend
+	for _, b := range p.backends {
+		if !b.up || b.draining {
+			continue
+		}
+		if best == nil || b.activeConn < best.activeConn {
+			best = b
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBackendAvailable
+	}
+	best.activeConn++
+	return best, nil
+}
+
+func (p *BackendPool) upBackendsLocked() []*Backend {
+	up := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.up && !b.draining {
+			up = append(up, b)
+		}
+	}
+	return up
+}
+
+// OnEvict 注册一个回调，在某个 draining 的后端因为超过 DrainTimeout 仍未排空、
+// 被强制清出池子时调用；Proxy 用它来结束仍然绑定在该后端上的会话
+func (p *BackendPool) OnEvict(fn func(*Backend)) {
+	p.mu.Lock()
+	p.onEvict = fn
+	p.mu.Unlock()
+}
+
+// Release 在客户端会话结束、不再使用某个后端时调用，递减其活跃连接数
+func (p *BackendPool) Release(b *Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b.activeConn > 0 {
+		b.activeConn--
+	}
+}
+
+// StartHealthChecks 启动一个后台协程，定期探测每个后端并更新其 up/down 状态；
+// 调用 StopHealthChecks 可以停止该协程
+func (p *BackendPool) StartHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.probeAll()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopHealthChecks 停止健康检查协程
+func (p *BackendPool) StopHealthChecks() {
+	close(p.stop)
+}
+
+// probeAll 对池中的每个后端发起一次探测拨号，并据此更新其健康状态
+func (p *BackendPool) probeAll() {
+	p.mu.Lock()
+	backends := make([]*Backend, len(p.backends))
+	copy(backends, p.backends)
+	p.mu.Unlock()
+
+	for _, b := range backends {
+		b := b
+		go p.probe(b)
+	}
+}
+
+func (p *BackendPool) probe(b *Backend) {
+	dialer := &websocket.Dialer{HandshakeTimeout: healthCheckTimeout}
+	conn, _, err := dialer.Dial(b.Addr, nil)
+
+	p.mu.Lock()
+	wasUp := b.up
+	b.up = err == nil
+	p.mu.Unlock()
+
+	if err != nil {
+		if wasUp {
+			fmt.Printf("Backend %s marked down: %v\n", b.Addr, err)
+		}
+		return
+	}
+	conn.Close()
+	if !wasUp {
+		fmt.Printf("Backend %s recovered, rejoining pool\n", b.Addr)
+	}
+}
+
+// Reconcile 让池子的成员与 desired 保持一致，供 Discovery 在成员集合变化时调用。
+// 新加入的地址先以 down 状态进入池子，待探测确认健康后才会参与选择；被移除的
+// 地址则进入 draining 状态，不再接受新连接，但已经占用它的连接可以继续，直至
+// 全部结束，或者 DrainTimeout 到期后被 forceEvict 强制清出池子
+func (p *BackendPool) Reconcile(desired []Backend) {
+	p.mu.Lock()
+
+	wanted := make(map[string]bool, len(desired))
+	for _, b := range desired {
+		wanted[b.Addr] = true
+	}
+
+	existing := make(map[string]bool, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.Addr] = true
+		switch {
+		case !wanted[b.Addr] && !b.draining:
+			p.startDrainingLocked(b)
+		case wanted[b.Addr] && b.draining:
+			// 之前被判定下线、进入了 draining，但在 DrainTimeout 到期前又重新出现在
+			// desired 里（比如短暂抖动后恢复）：撤销 draining，并让之前为它安排的
+			// forceEvict 定时器失效，避免它在已经被判定存活之后还被强制清出池子
+			b.draining = false
+			b.drainGen++
+		}
+	}
+
+	var newcomers []*Backend
+	for addr := range wanted {
+		if !existing[addr] {
+			b := &Backend{Addr: addr}
+			p.backends = append(p.backends, b)
+			newcomers = append(newcomers, b)
+		}
+	}
+
+	// 已经排空（没有连接在用）的下线成员可以立刻清出池子，不需要等到 DrainTimeout
+	kept := p.backends[:0]
+	for _, b := range p.backends {
+		if b.draining && b.activeConn == 0 {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	p.backends = kept
+
+	p.mu.Unlock()
+
+	for _, b := range newcomers {
+		fmt.Printf("Backend %s discovered, probing before it joins the pool\n", b.Addr)
+		go p.probe(b) // 新成员要等探测确认健康后才会被选中
+	}
+}
+
+// startDrainingLocked 把 b 标记为 draining 并安排一个定时器：如果 DrainTimeout
+// 到期时它仍然绑定着会话，forceEvict 会把它清出池子并通知 Proxy 结束那些会话。
+// drainGen 在定时器触发时会和 b 当前的世代比较，如果 Reconcile 在期间把它撤销
+// 又重新标记过 draining，这次过期的定时器就不应该生效。调用方必须已持有 p.mu
+func (p *BackendPool) startDrainingLocked(b *Backend) {
+	b.draining = true
+	b.drainDeadline = time.Now().Add(p.DrainTimeout)
+	b.drainGen++
+	gen := b.drainGen
+	time.AfterFunc(p.DrainTimeout, func() {
+		p.forceEvict(b, gen)
+	})
+}
+
+// forceEvict 在一个 draining 的后端超过 DrainTimeout 后仍未被 Reconcile 清理掉时
+// 调用：把它从池子里彻底移除，并通过 onEvict 通知 Proxy 强制结束仍然绑定在它身上
+// 的会话，而不是无限期地放任它们存在。gen 是安排这次定时器时的 drainGen，如果 b
+// 在定时器等待期间被撤销又重新 draining 过，gen 就会和 b 当前的世代不一致，
+// 这次过期的定时器直接忽略，而不是把一个又被判定存活的后端强制清出去
+func (p *BackendPool) forceEvict(b *Backend, gen int) {
+	p.mu.Lock()
+	if !b.draining || b.drainGen != gen {
+		p.mu.Unlock()
+		return // 这一轮 draining 早就被撤销了（后端又恢复存在），这次定时器已经过期作废
+	}
+	var evicted bool
+	kept := make([]*Backend, 0, len(p.backends))
+	for _, cur := range p.backends {
+		if cur == b {
+			evicted = true
+			continue
+		}
+		kept = append(kept, cur)
+	}
+	onEvict := p.onEvict
+	if evicted {
+		p.backends = kept
+	}
+	p.mu.Unlock()
+
+	if !evicted {
+		return // 已经在排空完成时被 Reconcile 正常清理过了
+	}
+	fmt.Printf("Backend %s exceeded drain timeout, forcing its remaining sessions off\n", b.Addr)
+	if onEvict != nil {
+		onEvict(b)
+	}
+}
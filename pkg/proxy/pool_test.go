@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestPool(policy Policy, addrs ...string) *BackendPool {
+	return NewBackendPool(addrs, policy)
+}
+
+func TestBackendPool_Next_RoundRobin(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a", "b", "c")
+
+	want := []string{"a", "b", "c", "a", "b"}
+	for i, w := range want {
+		b, err := pool.Next()
+		if err != nil {
+			t.Fatalf("call %d: unexpected error: %v", i, err)
+		}
+		if b.Addr != w {
+			t.Fatalf("call %d: got %q, want %q", i, b.Addr, w)
+		}
+	}
+}
+
+func TestBackendPool_Next_SkipsDownBackends(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a", "b", "c")
+	pool.backends[1].up = false // "b" 不健康
+
+	want := []string{"a", "c", "a", "c"}
+	for i, w := range want {
+		b, err := pool.Next()
+		if err != nil {
+			t.Fatalf("call %d: unexpected error: %v", i, err)
+		}
+		if b.Addr != w {
+			t.Fatalf("call %d: got %q, want %q", i, b.Addr, w)
+		}
+	}
+}
+
+func TestBackendPool_Next_NoBackendAvailable(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{"RoundRobin", RoundRobin},
+		{"Random", Random},
+		{"LeastConn", LeastConn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.policy, "a", "b")
+			for _, b := range pool.backends {
+				b.up = false
+			}
+
+			if _, err := pool.Next(); !errors.Is(err, ErrNoBackendAvailable) {
+				t.Fatalf("got error %v, want %v", err, ErrNoBackendAvailable)
+			}
+		})
+	}
+}
+
+func TestBackendPool_Next_LeastConn(t *testing.T) {
+	pool := newTestPool(LeastConn, "a", "b", "c")
+	pool.backends[0].activeConn = 5
+	pool.backends[1].activeConn = 1
+	pool.backends[2].activeConn = 3
+
+	b, err := pool.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Addr != "b" {
+		t.Fatalf("got %q, want %q", b.Addr, "b")
+	}
+	if b.activeConn != 2 {
+		t.Fatalf("Next should increment activeConn, got %d", b.activeConn)
+	}
+}
+
+func TestBackendPool_Release(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a")
+
+	b, err := pool.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.activeConn != 1 {
+		t.Fatalf("got activeConn %d, want 1", b.activeConn)
+	}
+
+	pool.Release(b)
+	if b.activeConn != 0 {
+		t.Fatalf("got activeConn %d, want 0", b.activeConn)
+	}
+
+	pool.Release(b) // 不应该把计数减到负数
+	if b.activeConn != 0 {
+		t.Fatalf("Release should not go below 0, got %d", b.activeConn)
+	}
+}
+
+func TestBackendPool_Reconcile_RemovesDrainedEmptyBackend(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a", "b")
+
+	pool.Reconcile([]Backend{{Addr: "b"}})
+
+	if len(pool.backends) != 1 || pool.backends[0].Addr != "b" {
+		t.Fatalf("got backends %+v, want only %q", pool.backends, "b")
+	}
+}
+
+func TestBackendPool_Reconcile_DrainsBackendWithActiveConn(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a")
+	b, err := pool.Next() // 占用 "a"，活跃连接数变为 1
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pool.Reconcile(nil) // "a" 不再是期望的成员
+
+	if len(pool.backends) != 1 {
+		t.Fatalf("draining backend with an active connection should stay in the pool, got %+v", pool.backends)
+	}
+	if !pool.backends[0].draining {
+		t.Fatalf("backend should be marked draining")
+	}
+
+	pool.Release(b)
+	pool.Reconcile(nil) // 再次 Reconcile，这次应该被清理掉
+
+	if len(pool.backends) != 0 {
+		t.Fatalf("drained backend with no active connections should be removed, got %+v", pool.backends)
+	}
+}
+
+func TestBackendPool_Reconcile_AddsNewcomers(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a")
+
+	pool.Reconcile([]Backend{{Addr: "a"}, {Addr: "b"}})
+
+	if len(pool.backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(pool.backends))
+	}
+	for _, addr := range []string{"a", "b"} {
+		found := false
+		for _, b := range pool.backends {
+			if b.Addr == addr {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected backend %q in pool, got %+v", addr, pool.backends)
+		}
+	}
+}
+
+func TestBackendPool_Reconcile_UndrainsFlappingBackend(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a")
+	pool.DrainTimeout = 50 * time.Millisecond
+
+	held, err := pool.Next() // 占用 "a"，使它在 draining 时不会因为排空完成而被立刻清理
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	evicted := make(chan *Backend, 1)
+	pool.OnEvict(func(b *Backend) { evicted <- b })
+
+	pool.Reconcile(nil)                    // "a" 短暂从 desired 里消失，开始 draining
+	pool.Reconcile([]Backend{{Addr: "a"}}) // 还没到 DrainTimeout，"a" 又重新出现在 desired 里
+
+	pool.mu.Lock()
+	if len(pool.backends) != 1 || pool.backends[0] != held || pool.backends[0].draining {
+		t.Fatalf("got backends %+v, want %q un-drained and unchanged", pool.backends, "a")
+	}
+	pool.mu.Unlock()
+
+	pool.Release(held)
+
+	select {
+	case got := <-evicted:
+		t.Fatalf("backend %+v should not be evicted after it was un-drained", got)
+	case <-time.After(200 * time.Millisecond):
+		// 原先那次 draining 安排的定时器应该已经过期作废，没有触发 forceEvict
+	}
+}
+
+func TestBackendPool_ForceEvictOnDrainTimeout(t *testing.T) {
+	pool := newTestPool(RoundRobin, "a")
+	pool.DrainTimeout = 10 * time.Millisecond
+
+	b, err := pool.Next() // 占用 "a"，使它无法在排空时被立刻清理
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	evicted := make(chan *Backend, 1)
+	pool.OnEvict(func(b *Backend) { evicted <- b })
+
+	pool.Reconcile(nil) // "a" 开始 draining，DrainTimeout 到期后应被强制清出
+
+	select {
+	case got := <-evicted:
+		if got != b {
+			t.Fatalf("got evicted backend %+v, want %+v", got, b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend was not evicted after DrainTimeout elapsed")
+	}
+
+	pool.mu.Lock()
+	remaining := len(pool.backends)
+	pool.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("got %d backends after force eviction, want 0", remaining)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoBackend 启动一个只是把收到的每条消息原样回发的测试后端，
+// 用于验证代理是否会在多个客户端之间错误地共享同一条后端连接
+func newEchoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func toWebsocketURL(httpURL string) string {
+	return "ws" + strings.TrimPrefix(httpURL, "http")
+}
+
+// TestHandleConnection_IsolatesConcurrentClients 是 chunk0-2 修复的回归测试：
+// 每个客户端连接都应该拨号到一条专属的后端连接，而不是共享同一个后端 socket。
+// 如果两个客户端的消息在后端连接上被混用，其中一个客户端迟早会收到本该发给
+// 另一个客户端的回显内容
+func TestHandleConnection_IsolatesConcurrentClients(t *testing.T) {
+	backend := newEchoBackend(t)
+
+	p := NewProxy([]string{toWebsocketURL(backend.URL)}, RoundRobin)
+	defer p.pool.StopHealthChecks()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", p.handleConnection)
+	proxySrv := httptest.NewServer(mux)
+	defer proxySrv.Close()
+
+	proxyWSURL := toWebsocketURL(proxySrv.URL) + "/ws"
+
+	const clients = 2
+	const messagesPerClient = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+
+			conn, _, err := websocket.DefaultDialer.Dial(proxyWSURL, nil)
+			if err != nil {
+				errs <- fmt.Errorf("client %d: dial failed: %w", clientID, err)
+				return
+			}
+			defer conn.Close()
+
+			prefix := fmt.Sprintf("client-%d-msg-", clientID)
+			for i := 0; i < messagesPerClient; i++ {
+				want := fmt.Sprintf("%s%d", prefix, i)
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(want)); err != nil {
+					errs <- fmt.Errorf("client %d: write failed: %w", clientID, err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, got, err := conn.ReadMessage()
+				if err != nil {
+					errs <- fmt.Errorf("client %d: read failed: %w", clientID, err)
+					return
+				}
+				if string(got) != want {
+					errs <- fmt.Errorf("client %d: got echo %q, want %q (cross-talk with another client's session)", clientID, got, want)
+					return
+				}
+			}
+		}(c)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -15,155 +17,354 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// 默认的心跳参数，取自 gorilla/websocket 的常见实践：
+// PongWait 必须大于 PingPeriod，留出网络往返的余量
+const (
+	defaultWriteWait      = 10 * time.Second
+	defaultPongWait       = 60 * time.Second
+	defaultPingPeriod     = (defaultPongWait * 9) / 10
+	defaultMaxMessageSize = 512 * 1024
+)
+
+// secWebSocketProtocolHeader 是客户端与后端协商子协议所用的请求/响应头
+const secWebSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+// defaultForwardedHeaders 是默认转发到后端拨号请求中的客户端请求头白名单
+var defaultForwardedHeaders = []string{"Authorization", "Cookie", "X-Forwarded-For"}
+
+// ClientSession 表示一个客户端连接及其专属的后端连接，两者的生命周期绑定在一起
+type ClientSession struct {
+	clientConn  *websocket.Conn // 客户端连接
+	backendConn *websocket.Conn // 该会话专属的后端连接
+	backend     *Backend        // 该会话当前占用的后端，用于归还连接计数
+	done        chan struct{}   // 任一方向出错时关闭，通知另一个协程退出
+	closeOnce   sync.Once       // 保证 done 只被关闭一次
+
+	clientWriteMu  sync.Mutex // 串行化对 clientConn 的写入（转发协程与心跳协程共用同一个连接）
+	backendWriteMu sync.Mutex // 串行化对 backendConn 的写入
+}
+
+// close 关闭该会话的 done 通道，是线程安全的幂等操作
+func (s *ClientSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// goingAway 在优雅关闭的等待时间用尽后调用，向客户端发送 1001 Going Away
+// 关闭帧，然后结束该会话
+func (s *ClientSession) goingAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	s.clientWriteMu.Lock()
+	s.clientConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(defaultWriteWait))
+	s.clientWriteMu.Unlock()
+	s.close()
+}
+
 // Proxy 结构体，用于管理连接和状态
 type Proxy struct {
-	connections    map[*websocket.Conn]time.Time // 存储客户端连接及其最后活动时间
-	lock           sync.Mutex                    // 用于并发访问的锁，确保线程安全
-	timeout        time.Duration                 // 空闲超时时间
-	backendAddress string                        // 后端服务的 WebSocket 地址
-	backendConn    *websocket.Conn               // 与后端服务的连接
+	sessions map[*websocket.Conn]*ClientSession // 每个客户端连接对应一个独立的会话
+	lock     sync.Mutex                         // 用于并发访问 sessions 的锁，确保线程安全
+	pool     *BackendPool                       // 后端地址池，负责选择和健康检查
+
+	// 心跳相关配置：用真正的 WebSocket ping/pong 判断连接是否存活，
+	// 而不是靠最近一次收发消息的时间做空闲超时（后者会误杀“安静但繁忙”的客户端）
+	PingPeriod     time.Duration // 发送 ping 的间隔
+	PongWait       time.Duration // 等待 pong 的最长时间，每收到一个 pong 重新计时，超时视为连接已死
+	WriteWait      time.Duration // 单次写操作（包括 ping、关闭帧）的超时时间
+	MaxMessageSize int64         // 单条消息允许的最大字节数
+
+	server       *http.Server  // 承载 /ws 路由的 HTTP 服务器
+	listener     net.Listener  // 服务器监听的 socket，重启时会被传递给子进程
+	draining     bool          // 为 true 时拒绝新的 WebSocket 升级请求，但允许现有会话继续
+	DrainTimeout time.Duration // 优雅关闭时，等待现有会话自行结束的最长时间
+
+	// ForwardedHeaders 是转发到后端拨号请求中的客户端请求头白名单，
+	// 默认转发 Authorization、Cookie、X-Forwarded-For
+	ForwardedHeaders []string
+
+	// PreStartProcess 在 SIGUSR2 触发的零停机重启之前被调用，
+	// 供调用方在 fork 子进程前做状态刷新（比如落盘、释放外部资源）
+	PreStartProcess func() error
+
+	discovery       Discovery          // 动态后端成员发现，nil 表示只使用 NewProxy 传入的静态地址
+	discoveryCancel context.CancelFunc // 停止 discovery 的 watch 协程
 }
 
-// NewProxy 创建一个新的 Proxy 实例
-func NewProxy(backendAddress string) *Proxy {
-	return &Proxy{
-		connections:    make(map[*websocket.Conn]time.Time), // 初始化连接映射
-		backendAddress: backendAddress,                      // 设置后端服务地址
-		timeout:        30 * time.Second,                    // 设置超时时间
+// Option 是配置 NewProxy 创建出的 Proxy 实例的可选项
+type Option func(*Proxy)
+
+// WithDiscovery 让 Proxy 的后端池通过 Discovery 动态维护成员，而不是只使用
+// NewProxy 传入的静态地址列表；Watch 送出的每一份成员集合都会被拿去和当前的
+// 后端池做一次 Reconcile
+func WithDiscovery(d Discovery) Option {
+	return func(p *Proxy) {
+		p.discovery = d
 	}
 }
 
-// connectToBackend 建立与后端服务的 WebSocket 连接
-func (p *Proxy) connectToBackend() (*websocket.Conn, error) {
-	// 使用默认的拨号器建立连接
-	conn, _, err := websocket.DefaultDialer.Dial(p.backendAddress, nil)
-	return conn, err // 返回连接和可能的错误
+// WithDrainTimeout 设置后端池的 DrainTimeout：Discovery 移除某个后端之后，池子
+// 最多等待其既有连接自行结束的时间，超过之后这些连接会被强制结束
+func WithDrainTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.pool.DrainTimeout = d
+	}
 }
 
-// handleConnection 处理新的客户端连接
-func (p *Proxy) handleConnection(w http.ResponseWriter, r *http.Request) {
-	// 将 HTTP 升级为 WebSocket 连接
-	conn, err := upgrader.Upgrade(w, r, nil)
+// NewProxy 创建一个新的 Proxy 实例，backendAddresses 中的每个地址都会被加入后端池，
+// policy 决定每个客户端连接如何在多个后端之间做选择；opts 可以用 WithDiscovery
+// 等选项定制可选行为
+func NewProxy(backendAddresses []string, policy Policy, opts ...Option) *Proxy {
+	pool := NewBackendPool(backendAddresses, policy)
+	pool.StartHealthChecks() // 启动后台健康检查，自动标记后端的上下线状态
+
+	p := &Proxy{
+		sessions:         make(map[*websocket.Conn]*ClientSession), // 初始化会话映射
+		pool:             pool,                                     // 设置后端池
+		PingPeriod:       defaultPingPeriod,
+		PongWait:         defaultPongWait,
+		WriteWait:        defaultWriteWait,
+		MaxMessageSize:   defaultMaxMessageSize,
+		DrainTimeout:     30 * time.Second, // 默认优雅关闭等待时间
+		ForwardedHeaders: defaultForwardedHeaders,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	pool.OnEvict(p.forceCloseSessionsForBackend)
+
+	if p.discovery != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.discoveryCancel = cancel
+		go p.watchDiscovery(ctx)
+	}
+
+	return p
+}
+
+// watchDiscovery 持续消费 discovery.Watch 送出的成员集合，并用它来更新后端池
+func (p *Proxy) watchDiscovery(ctx context.Context) {
+	ch, err := p.discovery.Watch(ctx)
 	if err != nil {
-		fmt.Println("Error while upgrading connection:", err)
+		fmt.Println("Error starting discovery watch:", err)
 		return
 	}
-	defer conn.Close() // 确保连接在函数结束时关闭
+	for {
+		select {
+		case backends, ok := <-ch:
+			if !ok {
+				return
+			}
+			p.pool.Reconcile(backends)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-	// 记录新的客户端连接及其最后活动时间
+// forceCloseSessionsForBackend 结束所有绑定在 b 上的会话，在 Discovery 把 b
+// 移除且超过 DrainTimeout 后仍有会话占用它时，由 BackendPool.OnEvict 回调触发
+func (p *Proxy) forceCloseSessionsForBackend(b *Backend) {
 	p.lock.Lock()
-	p.connections[conn] = time.Now()
+	var affected []*ClientSession
+	for _, s := range p.sessions {
+		if s.backend == b {
+			affected = append(affected, s)
+		}
+	}
 	p.lock.Unlock()
-	fmt.Printf("New connection established. Active connections: %d\n", len(p.connections))
 
-	// 如果没有与后端的连接，则建立连接
-	p.lock.Lock()
-	if p.backendConn == nil {
-		backendConn, err := p.connectToBackend() // 建立与后端的连接
-		if err != nil {
-			fmt.Println("Error connecting to backend:", err)
-			conn.Close() // 关闭客户端连接
-			p.lock.Unlock()
-			return
-		}
-		p.backendConn = backendConn // 记录后端连接
-		p.lock.Unlock()
+	for _, s := range affected {
+		s.goingAway()
+	}
+}
 
-		// 启动一个协程来读取后端服务的消息并转发到客户端
-		go p.forwardMessages(backendConn, conn)
+// buildBackendHeader 从客户端请求中取出白名单里的请求头以及协商子协议所需的
+// Sec-WebSocket-Protocol，组装成拨号后端时使用的请求头
+func (p *Proxy) buildBackendHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	for _, name := range p.ForwardedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	if proto := r.Header.Get(secWebSocketProtocolHeader); proto != "" {
+		header.Set(secWebSocketProtocolHeader, proto)
+	}
+	return header
+}
 
-		// 启动一个协程来监控后端连接的状态
-		go p.monitorBackendConnection()
-	} else {
-		p.lock.Unlock()
+// connectToBackend 从后端池中挑选一个健康的后端并建立连接，同时带上从客户端
+// 请求透传过来的请求头，返回的 *http.Response 可用于读取后端协商的子协议
+func (p *Proxy) connectToBackend(r *http.Request) (*websocket.Conn, *Backend, *http.Response, error) {
+	backend, err := p.pool.Next() // 根据选择策略挑选后端
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(backend.Addr, p.buildBackendHeader(r))
+	if err != nil {
+		p.pool.Release(backend) // 拨号失败，归还连接计数
+		return nil, nil, resp, err
 	}
+	return conn, backend, resp, nil
+}
 
-	// 启动一个协程来读取来自客户端的消息并转发到后端服务
-	go func() {
-		for {
-			_, msg, err := conn.ReadMessage() // 读取客户端消息
-			if err != nil {
-				fmt.Println("Client connection closed:", err)
-				break // 读取错误，结束循环
-			}
-			// 更新最后活跃时间
-			p.lock.Lock()
-			p.connections[conn] = time.Now()
-			p.lock.Unlock()
-
-			// 转发消息到后端服务
-			if err := p.backendConn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				fmt.Println("Error sending message to backend:", err)
-				break // 转发错误，结束循环
-			}
-		}
-	}()
+// configureKeepalive 给一条连接装上心跳所需的读取限制、读超时和 pong 处理器，
+// 之后只要对端仍然回应 ping，ReadMessage 就不会因为读超时而出错
+func (p *Proxy) configureKeepalive(conn *websocket.Conn) {
+	conn.SetReadLimit(p.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(p.PongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(p.PongWait))
+		return nil
+	})
+}
 
-	// 定期检查空闲连接和后端连接状态
+// pingLoop 周期性地向 conn 发送 ping 帧，直到 done 被关闭或写入失败
+func (p *Proxy) pingLoop(conn *websocket.Conn, writeMu *sync.Mutex, done <-chan struct{}) {
+	ticker := time.NewTicker(p.PingPeriod)
+	defer ticker.Stop()
 	for {
-		time.Sleep(5 * time.Second) // 每 5 秒检查一次
-		p.lock.Lock()
-		// 检查每个客户端连接的活跃状态
-		for c, lastActive := range p.connections {
-			if time.Since(lastActive) > p.timeout { // 判断是否超时
-				fmt.Println("Closing connection due to inactivity")
-				c.Close()                // 关闭空闲连接
-				delete(p.connections, c) // 从映射中删除连接
+		select {
+		case <-ticker.C:
+			writeMu.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(p.WriteWait))
+			writeMu.Unlock()
+			if err != nil {
+				return
 			}
+		case <-done:
+			return
 		}
-		fmt.Printf("Active connections: %d\n", len(p.connections))
+	}
+}
+
+// closeForwarder 返回一个 CloseHandler：先按协议要求向 src 回发一个关闭帧完成
+// 握手，再把同样的关闭码和原因转发给 dst，这样两端都能干净地结束，而不是各自
+// 因为读错误草草收场
+func (p *Proxy) closeForwarder(src, dst *websocket.Conn, srcWriteMu, dstWriteMu *sync.Mutex) func(code int, text string) error {
+	return func(code int, text string) error {
+		srcWriteMu.Lock()
+		src.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(p.WriteWait))
+		srcWriteMu.Unlock()
+
+		dstWriteMu.Lock()
+		dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(p.WriteWait))
+		dstWriteMu.Unlock()
+		return nil
+	}
+}
+
+// handleConnection 处理新的客户端连接
+func (p *Proxy) handleConnection(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	draining := p.draining
+	p.lock.Unlock()
+	if draining {
+		// 正在优雅关闭，不再接受新连接，但已有会话不受影响
+		http.Error(w, "proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 为该客户端连接单独拨号一个后端，互不共享；必须先拨号再升级客户端连接，
+	// 这样才能知道后端协商出的子协议，从而在升级响应里把它原样回传给客户端
+	backendConn, backend, backendResp, err := p.connectToBackend(r)
+	if err != nil {
+		fmt.Println("Error connecting to backend:", err)
+		return
+	}
 
-		// 如果没有任何客户端连接，则关闭与后端的连接
-		if len(p.connections) == 0 && p.backendConn != nil {
-			fmt.Println("No active client connections. Closing backend connection.")
-			p.backendConn.Close() // 关闭后端连接
-			p.backendConn = nil   // 重置后端连接
+	clientUpgrader := upgrader
+	if backendResp != nil {
+		if proto := backendResp.Header.Get(secWebSocketProtocolHeader); proto != "" {
+			clientUpgrader.Subprotocols = []string{proto}
 		}
-		p.lock.Unlock()
 	}
+
+	// 将 HTTP 升级为 WebSocket 连接
+	clientConn, err := clientUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println("Error while upgrading connection:", err)
+		backendConn.Close()
+		p.pool.Release(backend)
+		return
+	}
+
+	session := &ClientSession{
+		clientConn:  clientConn,
+		backendConn: backendConn,
+		backend:     backend,
+		done:        make(chan struct{}),
+	}
+
+	p.configureKeepalive(clientConn)
+	p.configureKeepalive(backendConn)
+	clientConn.SetCloseHandler(p.closeForwarder(clientConn, backendConn, &session.clientWriteMu, &session.backendWriteMu))
+	backendConn.SetCloseHandler(p.closeForwarder(backendConn, clientConn, &session.backendWriteMu, &session.clientWriteMu))
+
+	p.lock.Lock()
+	p.sessions[clientConn] = session
+	sessionCount := len(p.sessions)
+	p.lock.Unlock()
+	fmt.Printf("New connection established. Active connections: %d\n", sessionCount)
+
+	go p.clientToBackend(session)
+	go p.backendToClient(session)
+	go p.pingLoop(clientConn, &session.clientWriteMu, session.done)
+	go p.pingLoop(backendConn, &session.backendWriteMu, session.done)
+
+	<-session.done // 等待任一方向出错（含心跳超时）
+
+	p.lock.Lock()
+	delete(p.sessions, clientConn)
+	p.lock.Unlock()
+
+	clientConn.Close()
+	backendConn.Close()
+	p.pool.Release(backend)
+	fmt.Println("Session closed")
 }
 
-// forwardMessages 从后端服务读取消息并转发给客户端
-func (p *Proxy) forwardMessages(backendConn, clientConn *websocket.Conn) {
+// clientToBackend 读取客户端消息并转发到该会话专属的后端，直至出错
+func (p *Proxy) clientToBackend(s *ClientSession) {
+	defer s.close()
 	for {
-		_, msg, err := backendConn.ReadMessage() // 读取后端服务消息
+		messageType, msg, err := s.clientConn.ReadMessage()
 		if err != nil {
-			fmt.Println("Backend connection closed:", err)
-			break // 读取错误，结束循环
+			fmt.Println("Client connection closed:", err)
+			return
 		}
 
-		// 转发消息到客户端
-		if err := clientConn.WriteMessage(websocket.TextMessage, msg); err != nil {
-			fmt.Println("Error sending message to client:", err)
-			break // 转发错误，结束循环
+		s.backendWriteMu.Lock()
+		s.backendConn.SetWriteDeadline(time.Now().Add(p.WriteWait))
+		err = s.backendConn.WriteMessage(messageType, msg)
+		s.backendWriteMu.Unlock()
+		if err != nil {
+			fmt.Println("Error sending message to backend:", err)
+			return
 		}
 	}
 }
 
-// monitorBackendConnection 定期检查与后端的连接状态
-func (p *Proxy) monitorBackendConnection() {
+// backendToClient 读取后端消息并转发到该会话专属的客户端，直至出错
+func (p *Proxy) backendToClient(s *ClientSession) {
+	defer s.close()
 	for {
-		time.Sleep(10 * time.Second) // 每 10 秒检查一次
-		p.lock.Lock()
-		// 如果后端连接已关闭，则尝试重新连接
-		if p.backendConn == nil {
-			fmt.Println("Reconnecting to backend service...")
-			backendConn, err := p.connectToBackend()
-			if err != nil {
-				fmt.Println("Error reconnecting to backend:", err) // 连接错误
-			} else {
-				p.backendConn = backendConn // 记录新的后端连接
-			}
+		messageType, msg, err := s.backendConn.ReadMessage()
+		if err != nil {
+			fmt.Println("Backend connection closed:", err)
+			return
 		}
-		p.lock.Unlock()
-	}
-}
 
-// Start 启动 WebSocket 代理服务器
-func (p *Proxy) Start(address string) {
-	http.HandleFunc("/ws", p.handleConnection) // 注册处理函数
-	fmt.Printf("WebSocket proxy server started on %s\n", address)
-	if err := http.ListenAndServe(address, nil); err != nil {
-		fmt.Println("Error starting server:", err) // 启动服务器时出错
+		s.clientWriteMu.Lock()
+		s.clientConn.SetWriteDeadline(time.Now().Add(p.WriteWait))
+		err = s.clientConn.WriteMessage(messageType, msg)
+		s.clientWriteMu.Unlock()
+		if err != nil {
+			fmt.Println("Error sending message to client:", err)
+			return
+		}
 	}
 }